@@ -1,28 +1,520 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io"
 	"log/slog"
 	"math"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	agonesv1 "agones.dev/agones/pkg/apis/agones/v1"
 	autoscalingv1 "agones.dev/agones/pkg/apis/autoscaling/v1"
+	"golang.org/x/time/rate"
 )
 
-// Parameters which define thresholds to trigger scalling up and scale factor
+// defaultProfileName is the key handleAutoscale falls back to when a fleet
+// has no (or an unknown) "scalingProfile" annotation.
+const defaultProfileName = "default"
+
+// Profile bundles every tunable handleAutoscale uses to reach a scaling
+// decision. Operators can run several profiles side by side in one webhook
+// process (e.g. an aggressive "tournament" profile and a conservative
+// "casual" one) and select between them per-fleet via the "scalingProfile"
+// annotation; fleets without that annotation use the "default" profile.
+type Profile struct {
+	ReplicaUpperThreshold float64  `json:"replicaUpperThreshold"`
+	ReplicaLowerThreshold float64  `json:"replicaLowerThreshold"`
+	ScaleFactor           float64  `json:"scaleFactor"`
+	MinReplicas           string   `json:"minReplicas"`
+	MaxReplicas           string   `json:"maxReplicas"`
+	MaxSurge              string   `json:"maxSurge"`
+	MaxUnavailable        string   `json:"maxUnavailable"`
+	StabilizationWindow   string   `json:"stabilizationWindow"`
+	Policies              []Policy `json:"policies"`
+	// FixedReplicas subsumes the old FIXED_REPLICAS global flag: when true,
+	// handleAutoscale bypasses all scaling logic for this profile and takes
+	// its replica count from the fleet's "fixedReplicas" annotation, capped
+	// at the profile's MaxReplicas when that resolves above 0.
+	FixedReplicas bool `json:"fixedReplicas"`
+
+	// stabilization is StabilizationWindow parsed once at load time.
+	stabilization time.Duration
+}
+
+// defaultProfile holds the settings sourced from the top-level (non-profile)
+// env vars; it seeds the "default" entry of profiles and is the base that
+// every profile in SCALING_PROFILES_JSON overrides fields on top of.
+var defaultProfile = Profile{
+	ReplicaUpperThreshold: 0.7,
+	ReplicaLowerThreshold: 0.3,
+	ScaleFactor:           2.,
+	MinReplicas:           "2",
+	MaxReplicas:           "0",
+}
+
+// profiles is the resolved set of named scaling profiles, always containing
+// at least "default".
+var profiles = map[string]Profile{}
+
+// scaleDecision is one raw (pre-clamp) replica suggestion recorded for a
+// fleet, used to smooth out flapping between webhook calls.
+type scaleDecision struct {
+	Replicas  int32     `json:"replicas"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+var (
+	scaleStateMu sync.Mutex
+	scaleState   = map[string][]scaleDecision{}
+)
+
+// stateIdleTTL bounds how long a fleet's entry may sit in scaleState or
+// fleetLimiters after it was last touched before the sweeper reclaims it.
+// Without this, every distinct fleet name the webhook has ever seen would
+// stay resident forever, which is unbounded growth for churny/ephemeral
+// fleets (CI, per-match game fleets, etc.). Configurable via STATE_IDLE_TTL.
+var stateIdleTTL = 30 * time.Minute
+
+// evictIdleScaleState drops scaleState entries whose most recent decision is
+// older than stateIdleTTL, so fleets that have been deleted or renamed don't
+// linger in memory indefinitely.
+func evictIdleScaleState(now time.Time) {
+	scaleStateMu.Lock()
+	defer scaleStateMu.Unlock()
+
+	for key, decisions := range scaleState {
+		if len(decisions) == 0 {
+			delete(scaleState, key)
+			continue
+		}
+		if now.Sub(decisions[len(decisions)-1].Timestamp) > stateIdleTTL {
+			delete(scaleState, key)
+		}
+	}
+}
+
+// startStateEvictionSweeper periodically evicts idle scaleState and
+// fleetLimiters entries so long-running webhook processes don't accumulate
+// state for fleets that no longer exist.
+func startStateEvictionSweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			evictIdleScaleState(now)
+			evictIdleFleetLimiters(now)
+		}
+	}()
+}
+
+// stabilize reconciles a freshly computed raw replica suggestion (before
+// MIN/MAX_REPLICAS_COUNT clamping) against recent suggestions for the same
+// key within window, and returns the value to actually use. Scale-up always
+// wins immediately (max of cached and new); scale-down is only honoured once
+// every suggestion still inside the window agrees it's safe to go that low.
+// The cache stores raw, pre-clamp values so changing MIN/MAX_REPLICAS_COUNT
+// takes effect on the very next request rather than waiting for the window
+// to expire.
+func stabilize(key string, raw int32, now time.Time, window time.Duration) int32 {
+	if window <= 0 {
+		return raw
+	}
+
+	scaleStateMu.Lock()
+	defer scaleStateMu.Unlock()
+
+	cutoff := now.Add(-window)
+	decisions := scaleState[key]
+	fresh := decisions[:0]
+	for _, d := range decisions {
+		if d.Timestamp.After(cutoff) {
+			fresh = append(fresh, d)
+		}
+	}
+	decisions = fresh
+
+	stabilized := raw
+	if len(decisions) > 0 {
+		cached := decisions[0].Replicas
+		for _, d := range decisions[1:] {
+			if d.Replicas > cached {
+				cached = d.Replicas
+			}
+		}
+		switch {
+		case raw > cached:
+			stabilized = raw
+		case raw < cached:
+			allowDown := true
+			for _, d := range decisions {
+				if d.Replicas > raw {
+					allowDown = false
+					break
+				}
+			}
+			if !allowDown {
+				stabilized = cached
+			}
+		default:
+			stabilized = cached
+		}
+	}
+
+	decisions = append(decisions, scaleDecision{Replicas: raw, Timestamp: now})
+	scaleState[key] = decisions
+	return stabilized
+}
+
+// scaleRPS/scaleBurst configure the global token-bucket limiter guarding
+// /scale; globalLimiter is nil (no limiting) unless SCALE_RPS is set.
+// fleetRPS/fleetBurst configure the per-fleet limiters and default to a
+// quarter of the global budget, so one fleet alone can never exhaust the
+// capacity every other fleet depends on. SCALE_FLEET_RPS/SCALE_FLEET_BURST
+// let operators size that fraction explicitly instead.
 var (
-	replicaUpperThreshold        = 0.7
-	replicaLowerThreshold        = 0.3
-	scaleFactor                  = 2.
-	minReplicasCount             = int32(2)
-	maxReplicasCount             = int32(0)
-	fixedReplicasOverrideEnabled bool
+	scaleRPS      float64
+	scaleBurst    = 1
+	globalLimiter *rate.Limiter
+
+	fleetRPS   float64
+	fleetBurst = 1
+
+	fleetLimitersMu sync.Mutex
+	fleetLimiters   = map[string]*fleetLimiterEntry{}
 )
 
+// fleetLimiterEntry pairs a fleet's token-bucket limiter with the last time
+// it was used, so evictIdleFleetLimiters can reclaim entries for fleets that
+// have been deleted or renamed instead of keeping them forever.
+type fleetLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// fleetLimiter returns the per-fleet token-bucket limiter for name, creating
+// one on first use so a single chatty fleet can't exhaust capacity that
+// other fleets need.
+func fleetLimiter(name string, now time.Time) *rate.Limiter {
+	fleetLimitersMu.Lock()
+	defer fleetLimitersMu.Unlock()
+
+	entry, ok := fleetLimiters[name]
+	if !ok {
+		entry = &fleetLimiterEntry{limiter: rate.NewLimiter(rate.Limit(fleetRPS), fleetBurst)}
+		fleetLimiters[name] = entry
+	}
+	entry.lastUsed = now
+	return entry.limiter
+}
+
+// evictIdleFleetLimiters drops fleetLimiters entries that haven't been used
+// in stateIdleTTL, so long-running webhook processes don't accumulate a
+// limiter per fleet name they've ever seen.
+func evictIdleFleetLimiters(now time.Time) {
+	fleetLimitersMu.Lock()
+	defer fleetLimitersMu.Unlock()
+
+	for name, entry := range fleetLimiters {
+		if now.Sub(entry.lastUsed) > stateIdleTTL {
+			delete(fleetLimiters, name)
+		}
+	}
+}
+
+// rateLimitMiddleware wraps handleAutoscale with a global and a per-fleet
+// token-bucket limiter. When either denies a request, it responds 429 with a
+// Retry-After header and a Scale:false/currentReplicas body, so the Agones
+// FAS webhook treats the tick as a no-op instead of an error.
+func rateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if globalLimiter == nil {
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var faReq autoscalingv1.FleetAutoscaleReview
+		if err := json.Unmarshal(body, &faReq); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		tripped := ""
+		if !globalLimiter.Allow() {
+			tripped = "global"
+		} else if !fleetLimiter(faReq.Request.Name, time.Now()).Allow() {
+			tripped = "fleet:" + faReq.Request.Name
+		}
+		if tripped != "" {
+			slog.Warn("Rate limit tripped; treating /scale request as a no-op", "limiter", tripped)
+			w.Header().Set("Retry-After", "1")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			faResp := autoscalingv1.FleetAutoscaleResponse{
+				Scale:    false,
+				Replicas: faReq.Request.Status.Replicas,
+				UID:      faReq.Request.UID,
+			}
+			review := &autoscalingv1.FleetAutoscaleReview{
+				Request:  faReq.Request,
+				Response: &faResp,
+			}
+			_ = json.NewEncoder(w).Encode(review)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// resolveIntOrPercent resolves a MIN/MAX_REPLICAS_COUNT-style value against a
+// base, following the same int-or-percent convention Kubernetes uses for
+// maxSurge/maxUnavailable: a plain integer ("10") is returned as-is, while a
+// percentage ("25%") is evaluated as ceil(base*pct/100) when roundUp is true,
+// or truncated otherwise. Values are re-resolved on every request so that
+// operators changing the underlying base see the effect immediately.
+func resolveIntOrPercent(value string, base int32, roundUp bool) int32 {
+	if value == "" {
+		return 0
+	}
+	if pct, ok := strings.CutSuffix(value, "%"); ok {
+		f, err := strconv.ParseFloat(pct, 64)
+		if err != nil {
+			slog.Error("Could not parse percentage value", "value", value, "error", err)
+			return 0
+		}
+		if f < 0 {
+			slog.Error("int-or-percent value cannot be negative", "value", value)
+			return 0
+		}
+		result := float64(base) * f / 100
+		if roundUp {
+			return int32(math.Ceil(result))
+		}
+		return int32(result)
+	}
+	n, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		slog.Error("Could not parse int-or-percent value", "value", value, "error", err)
+		return 0
+	}
+	if n < 0 {
+		slog.Error("int-or-percent value cannot be negative", "value", value)
+		return 0
+	}
+	return int32(n)
+}
+
+// validateIntOrPercent checks that a string is either a plain integer or a
+// percentage (e.g. "25%"), without resolving it against a base. Negative
+// values are rejected in both forms, matching the >= 0 guarantee the old
+// plain-integer MIN_REPLICAS_COUNT/MAX_REPLICAS_COUNT parsing used to give.
+// Used at startup so malformed env vars fail fast instead of silently
+// resolving to 0 on the first request.
+func validateIntOrPercent(value string) error {
+	if pct, ok := strings.CutSuffix(value, "%"); ok {
+		f, err := strconv.ParseFloat(pct, 64)
+		if err != nil {
+			return err
+		}
+		if f < 0 {
+			return fmt.Errorf("value cannot be negative: %q", value)
+		}
+		return nil
+	}
+	n, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return fmt.Errorf("value cannot be negative: %q", value)
+	}
+	return nil
+}
+
+// governor caps a proposed replica count so a single tick never surges the
+// fleet past current+MAX_SURGE, and never scales down Ready capacity below
+// AllocatedReplicas+MAX_UNAVAILABLE, so Allocated GameServers are never
+// targeted for removal. A MAX_SURGE that is unset or resolves to 0 leaves
+// scale-up uncapped. Modeled on Agones' RollingUpdate fleet strategy.
+func governor(current, allocated, next int32, maxSurgeRaw, maxUnavailableRaw string) int32 {
+	if next > current {
+		if maxSurge := resolveIntOrPercent(maxSurgeRaw, current, true); maxSurge > 0 && next > current+maxSurge {
+			next = current + maxSurge
+		}
+	} else if next < current {
+		if maxUnavailable := resolveIntOrPercent(maxUnavailableRaw, current, true); next < allocated+maxUnavailable {
+			next = allocated + maxUnavailable
+		}
+	}
+	return next
+}
+
+// Policy targets a single Counter or List resource exposed on FleetStatus and
+// describes how much headroom (buffer) to keep in front of its current usage.
+// Policies are evaluated independently; the largest resulting desired replica
+// count across all policies wins, so e.g. "rooms" and "players" can both
+// drive scale without one starving the other.
+type Policy struct {
+	// Resource is the key into FleetStatus.Counters or FleetStatus.Lists.
+	Resource string `json:"resource"`
+	// Kind is either "Counter" or "List".
+	Kind string `json:"kind"`
+	// BufferSize is the amount of spare capacity to keep ahead of current
+	// usage, either a plain integer ("25") or a percentage ("25%").
+	BufferSize string `json:"bufferSize"`
+	// MinCapacity and MaxCapacity clamp the desired capacity before it is
+	// converted into a replica count.
+	MinCapacity int64 `json:"minCapacity"`
+	MaxCapacity int64 `json:"maxCapacity"`
+}
+
+// clampCapacity clamps a desired capacity to a policy's [MinCapacity,
+// MaxCapacity] bounds. A zero MaxCapacity means "no upper bound".
+func clampCapacity(desired int64, p Policy) int64 {
+	if desired < p.MinCapacity {
+		desired = p.MinCapacity
+	}
+	if p.MaxCapacity > 0 && desired > p.MaxCapacity {
+		desired = p.MaxCapacity
+	}
+	return desired
+}
+
+// evaluatePolicies computes the desired replica count implied by each policy
+// against the Counters/Lists reported on status, and returns the largest one.
+// The second return value is false when no policy matched a reported
+// resource, signalling the caller should fall back to other heuristics.
+func evaluatePolicies(policies []Policy, status agonesv1.FleetStatus, currentReplicas int32) (int32, bool) {
+	var desiredReplicas int32
+	matched := false
+
+	for _, p := range policies {
+		var count, capacity int64
+		switch p.Kind {
+		case "Counter":
+			counter, ok := status.Counters[p.Resource]
+			if !ok {
+				continue
+			}
+			count, capacity = counter.Count, counter.Capacity
+		case "List":
+			list, ok := status.Lists[p.Resource]
+			if !ok {
+				continue
+			}
+			count, capacity = list.Count, list.Capacity
+		default:
+			slog.Error("Unknown policy kind", "kind", p.Kind, "resource", p.Resource)
+			continue
+		}
+
+		if capacity <= 0 || currentReplicas <= 0 {
+			continue
+		}
+
+		buffer := int64(resolveIntOrPercent(p.BufferSize, int32(capacity), true))
+		desiredCapacity := clampCapacity(count+buffer, p)
+		replicas := int32(math.Ceil(float64(desiredCapacity) * float64(currentReplicas) / float64(capacity)))
+
+		slog.Info("Evaluated scaling policy", "resource", p.Resource, "kind", p.Kind,
+			"count", count, "capacity", capacity, "buffer", buffer, "desiredCapacity", desiredCapacity,
+			"replicas", replicas)
+
+		if !matched || replicas > desiredReplicas {
+			desiredReplicas = replicas
+		}
+		matched = true
+	}
+
+	return desiredReplicas, matched
+}
+
+// loadProfiles seeds profiles with defaultProfile under "default", then
+// layers any profiles declared in SCALING_PROFILES_JSON on top. Each entry
+// there is unmarshalled onto a copy of defaultProfile, so a profile only
+// needs to specify the fields it wants to override (e.g. a "tournament"
+// profile overriding just scaleFactor/minReplicas still inherits the
+// default's policies and thresholds).
+func loadProfiles() {
+	profiles = map[string]Profile{defaultProfileName: defaultProfile}
+
+	raw := os.Getenv("SCALING_PROFILES_JSON")
+	if raw == "" {
+		return
+	}
+
+	var rawProfiles map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &rawProfiles); err != nil {
+		slog.Error("Could not parse SCALING_PROFILES_JSON variable", "error", err)
+		os.Exit(1)
+	}
+
+	for name, msg := range rawProfiles {
+		p := defaultProfile
+		if err := json.Unmarshal(msg, &p); err != nil {
+			slog.Error("Could not parse scaling profile", "profile", name, "error", err)
+			os.Exit(1)
+		}
+
+		for field, value := range map[string]string{
+			"minReplicas":    p.MinReplicas,
+			"maxReplicas":    p.MaxReplicas,
+			"maxSurge":       p.MaxSurge,
+			"maxUnavailable": p.MaxUnavailable,
+		} {
+			if value == "" {
+				continue
+			}
+			if err := validateIntOrPercent(value); err != nil {
+				slog.Error("Invalid int-or-percent value in scaling profile", "profile", name, "field", field, "error", err)
+				os.Exit(1)
+			}
+		}
+
+		// A profile that doesn't mention "stabilizationWindow" at all keeps
+		// the StabilizationWindow and stabilization copied from
+		// defaultProfile, but one that explicitly sets it to "" is opting back
+		// out of that inherited window. When defaultProfile.StabilizationWindow
+		// is itself "", both cases leave p.StabilizationWindow == "", so the
+		// raw message has to be consulted to tell them apart.
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(msg, &fields); err != nil {
+			slog.Error("Could not parse scaling profile", "profile", name, "error", err)
+			os.Exit(1)
+		}
+		_, explicitWindow := fields["stabilizationWindow"]
+
+		switch {
+		case p.StabilizationWindow != "":
+			window, err := time.ParseDuration(p.StabilizationWindow)
+			if err != nil {
+				slog.Error("Could not parse stabilizationWindow for scaling profile", "profile", name, "error", err)
+				os.Exit(1)
+			}
+			p.stabilization = window
+		case explicitWindow:
+			p.stabilization = 0
+		}
+
+		profiles[name] = p
+	}
+}
+
 // Get all parameters from ENV variables
 // Extra check is performed not to fall into the infinite loop:
 // replicaDownTrigger < replicaUpperThreshold/scaleFactor
@@ -33,7 +525,7 @@ func getEnvVariables() {
 			slog.Error("Could not parse environment SCALE_FACTOR variable", "error", err)
 			os.Exit(1)
 		} else if factor > 1 {
-			scaleFactor = factor
+			defaultProfile.ScaleFactor = factor
 		}
 	}
 
@@ -43,7 +535,7 @@ func getEnvVariables() {
 			slog.Error("Could not parse environment REPLICA_UPSCALE_TRIGGER variable", "error", err)
 			os.Exit(1)
 		} else if replicaUpTrigger > 0.1 {
-			replicaUpperThreshold = replicaUpTrigger
+			defaultProfile.ReplicaUpperThreshold = replicaUpTrigger
 		}
 	}
 
@@ -52,54 +544,149 @@ func getEnvVariables() {
 		if err != nil {
 			slog.Error("Could not parse environment REPLICA_DOWNSCALE_TRIGGER variable", "error", err)
 			os.Exit(1)
-		} else if replicaDownTrigger < replicaUpperThreshold/scaleFactor {
-			replicaLowerThreshold = replicaDownTrigger
+		} else if replicaDownTrigger < defaultProfile.ReplicaUpperThreshold/defaultProfile.ScaleFactor {
+			defaultProfile.ReplicaLowerThreshold = replicaDownTrigger
 		}
 	}
 
 	if ep := os.Getenv("MIN_REPLICAS_COUNT"); ep != "" {
-		minReplicas, err := strconv.ParseInt(ep, 10, 32)
-		if err != nil {
+		if err := validateIntOrPercent(ep); err != nil {
 			slog.Error("Could not parse environment MIN_REPLICAS_COUNT variable", "error", err)
 			os.Exit(1)
-		} else if minReplicas >= 0 {
-			minReplicasCount = int32(minReplicas)
 		}
+		defaultProfile.MinReplicas = ep
 	}
 
 	if ep := os.Getenv("MAX_REPLICAS_COUNT"); ep != "" {
-		maxReplicas, err := strconv.ParseInt(ep, 10, 32)
-		if err != nil {
+		if err := validateIntOrPercent(ep); err != nil {
 			slog.Error("Could not parse environment MAX_REPLICAS_COUNT variable", "error", err)
 			os.Exit(1)
-		} else if maxReplicas >= 0 {
-			maxReplicasCount = int32(maxReplicas)
+		}
+		defaultProfile.MaxReplicas = ep
+	}
+
+	if ep := os.Getenv("MAX_SURGE"); ep != "" {
+		if err := validateIntOrPercent(ep); err != nil {
+			slog.Error("Could not parse environment MAX_SURGE variable", "error", err)
+			os.Exit(1)
+		}
+		defaultProfile.MaxSurge = ep
+	}
+
+	if ep := os.Getenv("MAX_UNAVAILABLE"); ep != "" {
+		if err := validateIntOrPercent(ep); err != nil {
+			slog.Error("Could not parse environment MAX_UNAVAILABLE variable", "error", err)
+			os.Exit(1)
+		}
+		defaultProfile.MaxUnavailable = ep
+	}
+
+	if ep := os.Getenv("STABILIZATION_WINDOW"); ep != "" {
+		window, err := time.ParseDuration(ep)
+		if err != nil {
+			slog.Error("Could not parse environment STABILIZATION_WINDOW variable", "error", err)
+			os.Exit(1)
+		} else if window >= 0 {
+			defaultProfile.StabilizationWindow = ep
+			defaultProfile.stabilization = window
+		}
+	}
+
+	if ep := os.Getenv("STATE_IDLE_TTL"); ep != "" {
+		ttl, err := time.ParseDuration(ep)
+		if err != nil {
+			slog.Error("Could not parse environment STATE_IDLE_TTL variable", "error", err)
+			os.Exit(1)
+		} else if ttl > 0 {
+			stateIdleTTL = ttl
 		}
 	}
 
 	if ep := os.Getenv("FIXED_REPLICAS"); ep != "" {
 		if ep == "true" {
-			fixedReplicasOverrideEnabled = true
+			defaultProfile.FixedReplicas = true
 			slog.Info("FIXED_REPLICAS override is enabled")
 		} else {
-			fixedReplicasOverrideEnabled = false
+			defaultProfile.FixedReplicas = false
 			slog.Info("FIXED_REPLICAS override is disabled")
 		}
 	}
 
-	// No need to read ROOMS_PER_REPLICA; we derive from room.Capacity
+	if ep := os.Getenv("SCALE_BURST"); ep != "" {
+		burst, err := strconv.ParseInt(ep, 10, 32)
+		if err != nil {
+			slog.Error("Could not parse environment SCALE_BURST variable", "error", err)
+			os.Exit(1)
+		} else if burst > 0 {
+			scaleBurst = int(burst)
+		}
+	}
+
+	if ep := os.Getenv("SCALE_RPS"); ep != "" {
+		rps, err := strconv.ParseFloat(ep, 64)
+		if err != nil {
+			slog.Error("Could not parse environment SCALE_RPS variable", "error", err)
+			os.Exit(1)
+		} else if rps > 0 {
+			scaleRPS = rps
+			globalLimiter = rate.NewLimiter(rate.Limit(scaleRPS), scaleBurst)
+		}
+	}
+
+	// Default the per-fleet budget to a quarter of the global one so a
+	// single fleet can never alone consume the whole shared allowance.
+	fleetBurst = scaleBurst / 4
+	if fleetBurst < 1 {
+		fleetBurst = 1
+	}
+	fleetRPS = scaleRPS / 4
+
+	if ep := os.Getenv("SCALE_FLEET_BURST"); ep != "" {
+		burst, err := strconv.ParseInt(ep, 10, 32)
+		if err != nil {
+			slog.Error("Could not parse environment SCALE_FLEET_BURST variable", "error", err)
+			os.Exit(1)
+		} else if burst > 0 {
+			fleetBurst = int(burst)
+		}
+	}
+
+	if ep := os.Getenv("SCALE_FLEET_RPS"); ep != "" {
+		rps, err := strconv.ParseFloat(ep, 64)
+		if err != nil {
+			slog.Error("Could not parse environment SCALE_FLEET_RPS variable", "error", err)
+			os.Exit(1)
+		} else if rps > 0 {
+			fleetRPS = rps
+		}
+	}
+
+	if ep := os.Getenv("SCALING_POLICY_JSON"); ep != "" {
+		if err := json.Unmarshal([]byte(ep), &defaultProfile.Policies); err != nil {
+			slog.Error("Could not parse SCALING_POLICY_JSON variable", "error", err)
+			os.Exit(1)
+		}
+	}
 
 	// Extra check: In order not to fall into infinite loop
 	// we change down scale trigger, so that after we scale up
 	// fleet does not immediately scales down and vice versa
-	if replicaLowerThreshold >= replicaUpperThreshold/scaleFactor {
-		replicaLowerThreshold = replicaUpperThreshold / (scaleFactor + 1)
+	if defaultProfile.ReplicaLowerThreshold >= defaultProfile.ReplicaUpperThreshold/defaultProfile.ScaleFactor {
+		defaultProfile.ReplicaLowerThreshold = defaultProfile.ReplicaUpperThreshold / (defaultProfile.ScaleFactor + 1)
 	}
 
-	if maxReplicasCount > 0 && minReplicasCount > maxReplicasCount {
-		slog.Info("MIN_REPLICAS_COUNT exceeds MAX_REPLICAS_COUNT; adjusting min to max", "min", minReplicasCount, "max", maxReplicasCount)
-		minReplicasCount = maxReplicasCount
+	// Percentages resolve against the per-request replica count, so min/max
+	// can only be sanity-checked here when both are given as plain integers.
+	if !strings.HasSuffix(defaultProfile.MinReplicas, "%") && !strings.HasSuffix(defaultProfile.MaxReplicas, "%") {
+		min, _ := strconv.ParseInt(defaultProfile.MinReplicas, 10, 32)
+		max, _ := strconv.ParseInt(defaultProfile.MaxReplicas, 10, 32)
+		if max > 0 && min > max {
+			slog.Info("MIN_REPLICAS_COUNT exceeds MAX_REPLICAS_COUNT; adjusting min to max", "min", min, "max", max)
+			defaultProfile.MinReplicas = defaultProfile.MaxReplicas
+		}
 	}
+
+	loadProfiles()
 }
 
 // Main will set up an http server and three endpoints
@@ -117,12 +704,16 @@ func main() {
 		port = &ep
 	}
 	getEnvVariables()
+	startStateEvictionSweeper(5 * time.Minute)
 	// Run the HTTP server using the bound certificate and key for TLS
 	// Serve 200 status on /health for k8s health checks
 	http.HandleFunc("/health", handleHealth)
 
 	// Return the target replica count which is used by Webhook fleet autoscaling policy
-	http.HandleFunc("/scale", handleAutoscale)
+	http.HandleFunc("/scale", rateLimitMiddleware(handleAutoscale))
+
+	// Expose the stabilization cache for observability
+	http.HandleFunc("/debug/scale-state", handleDebugScaleState)
 
 	_, err := os.Stat("/home/service/certs/tls.crt")
 	if err == nil {
@@ -146,6 +737,21 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// handleDebugScaleState dumps the in-memory stabilization cache so operators
+// can see what recent raw suggestions are keeping a fleet's replica count
+// from flapping.
+func handleDebugScaleState(w http.ResponseWriter, r *http.Request) {
+	scaleStateMu.Lock()
+	state := make(map[string][]scaleDecision, len(scaleState))
+	for key, decisions := range scaleState {
+		state[key] = append([]scaleDecision(nil), decisions...)
+	}
+	scaleStateMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(state)
+}
+
 // handleAutoscale is a handler function which return the replica count
 // based on received status of the fleet
 func handleAutoscale(w http.ResponseWriter, r *http.Request) {
@@ -165,7 +771,27 @@ func handleAutoscale(w http.ResponseWriter, r *http.Request) {
 		UID:      faReq.Request.UID,
 	}
 
-	if fixedReplicasOverrideEnabled {
+	profileName := defaultProfileName
+	if faReq.Request.Annotations != nil {
+		if v, ok := faReq.Request.Annotations["scalingProfile"]; ok && v != "" {
+			profileName = v
+		}
+	}
+	profile, ok := profiles[profileName]
+	if !ok {
+		slog.Info("Unknown scalingProfile annotation; falling back to default", "profile", profileName)
+		profile = profiles[defaultProfileName]
+	}
+
+	// Resolved fresh on every request since either bound may be a percentage
+	// of the fleet's current replica count.
+	minReplicas := resolveIntOrPercent(profile.MinReplicas, faReq.Request.Status.Replicas, true)
+	maxReplicas := resolveIntOrPercent(profile.MaxReplicas, faReq.Request.Status.Replicas, true)
+	if maxReplicas > 0 && minReplicas > maxReplicas {
+		minReplicas = maxReplicas
+	}
+
+	if profile.FixedReplicas {
 		if faReq.Request.Annotations != nil {
 			if value, ok := faReq.Request.Annotations["fixedReplicas"]; ok {
 				replicas, err := strconv.Atoi(value)
@@ -183,69 +809,79 @@ func handleAutoscale(w http.ResponseWriter, r *http.Request) {
 
 				faResp.Scale = true
 				faResp.Replicas = int32(replicas)
+				if maxReplicas > 0 && faResp.Replicas > maxReplicas {
+					faResp.Replicas = maxReplicas
+				}
 			}
 		}
 	} else if faReq.Request.Status.Replicas != 0 {
-		// If FleetStatus exposes a "room" counter, derive replicas from it.
-		// FleetStatus.Counters["room"].Capacity is aggregated across the fleet.
-		// capacityPerReplica = room.Capacity / currentReplicas
-		// desiredReplicas = ceil(room.Count / capacityPerReplica)
-		if faReq.Request.Status.Counters != nil {
-			if room, ok := faReq.Request.Status.Counters["rooms"]; ok {
-				// room.Count is expected to be an int64 aggregate across the fleet
-				// room.Capacity is aggregated capacity across the fleet
-				if room.Capacity > 0 && faReq.Request.Status.Replicas > 0 {
-					current := faReq.Request.Status.Replicas
-					capPerReplica := 5.0 // fixed value for now
-					// Base target needed to cover rooms with current per-replica capacity
-					desired := int32(math.Ceil(float64(room.Count) / capPerReplica))
-					// Clamp base desired to min/max bounds
-					if desired < minReplicasCount {
-						desired = minReplicasCount
-					}
-					if maxReplicasCount > 0 && desired > maxReplicasCount {
-						desired = maxReplicasCount
-					}
-					slog.Info("Calculated capacityPerReplica", "capacityPerReplica", capPerReplica, ", desired", desired, ", current", current, ", min", minReplicasCount, ", max", maxReplicasCount)
-					// ignore a threshold
-					next := int32(math.Ceil(float64(desired) * scaleFactor))
-					// Final clamp to global bounds
-					if next < minReplicasCount {
-						next = minReplicasCount
-					}
-					if maxReplicasCount > 0 && next > maxReplicasCount {
-						next = maxReplicasCount
-					}
-					// scale up only if needed
-					if next != current {
-						faResp.Scale = true
-						faResp.Replicas = next
-					}
-					// Proceed to response
-					w.Header().Set("Content-Type", "application/json")
-					review := &autoscalingv1.FleetAutoscaleReview{
-						Request:  faReq.Request,
-						Response: &faResp,
-					}
-					_ = json.NewEncoder(w).Encode(review)
-					return
-				}
+		// If any Counter/List policies are configured, let them drive scale
+		// ahead of the allocated-percentage heuristic below.
+		if desired, matched := evaluatePolicies(profile.Policies, faReq.Request.Status, faReq.Request.Status.Replicas); matched {
+			current := faReq.Request.Status.Replicas
+			next := stabilize(faReq.Request.Name, desired, time.Now(), profile.stabilization)
+			if next < minReplicas {
+				next = minReplicas
+			}
+			if maxReplicas > 0 && next > maxReplicas {
+				next = maxReplicas
 			}
+			governed := governor(current, faReq.Request.Status.AllocatedReplicas, next, profile.MaxSurge, profile.MaxUnavailable)
+			if governed != next {
+				slog.Info("Governor adjusted replica count", "pre", next, "post", governed)
+				next = governed
+			}
+			if next != current {
+				faResp.Scale = true
+				faResp.Replicas = next
+			}
+			w.Header().Set("Content-Type", "application/json")
+			review := &autoscalingv1.FleetAutoscaleReview{
+				Request:  faReq.Request,
+				Response: &faResp,
+			}
+			_ = json.NewEncoder(w).Encode(review)
+			return
 		}
 		allocatedPercent := float64(faReq.Request.Status.AllocatedReplicas) / float64(faReq.Request.Status.Replicas)
-		if allocatedPercent > replicaUpperThreshold {
+		if allocatedPercent > profile.ReplicaUpperThreshold {
 			// After scaling we would have percentage of 0.7/2 = 0.35 > replicaLowerThreshold
 			// So we won't scale down immediately after scale up
 			currentReplicas := float64(faReq.Request.Status.Replicas)
-			faResp.Scale = true
-			next := int32(math.Ceil(currentReplicas * scaleFactor))
-			if maxReplicasCount > 0 && next > maxReplicasCount {
-				next = maxReplicasCount
+			next := stabilize(faReq.Request.Name, int32(math.Ceil(currentReplicas*profile.ScaleFactor)), time.Now(), profile.stabilization)
+			if maxReplicas > 0 && next > maxReplicas {
+				next = maxReplicas
+			}
+			governed := governor(faReq.Request.Status.Replicas, faReq.Request.Status.AllocatedReplicas, next, profile.MaxSurge, profile.MaxUnavailable)
+			if governed != next {
+				slog.Info("Governor adjusted replica count", "pre", next, "post", governed)
+				next = governed
+			}
+			// The governor may have pulled next back down to the fleet's
+			// current replica count (e.g. a fully-allocated fleet with no
+			// maxSurge headroom), so only report a scale when it actually
+			// changes anything.
+			if next != faReq.Request.Status.Replicas {
+				faResp.Scale = true
+				faResp.Replicas = next
+			}
+		} else if allocatedPercent < profile.ReplicaLowerThreshold && faReq.Request.Status.Replicas > minReplicas {
+			next := stabilize(faReq.Request.Name, int32(math.Ceil(float64(faReq.Request.Status.Replicas)/profile.ScaleFactor)), time.Now(), profile.stabilization)
+			if next < minReplicas {
+				next = minReplicas
+			}
+			governed := governor(faReq.Request.Status.Replicas, faReq.Request.Status.AllocatedReplicas, next, profile.MaxSurge, profile.MaxUnavailable)
+			if governed != next {
+				slog.Info("Governor adjusted replica count", "pre", next, "post", governed)
+				next = governed
+			}
+			// The governor may have floored next back up to the fleet's
+			// current replica count, so only report a scale when it
+			// actually changes anything.
+			if next != faReq.Request.Status.Replicas {
+				faResp.Scale = true
+				faResp.Replicas = next
 			}
-			faResp.Replicas = next
-		} else if allocatedPercent < replicaLowerThreshold && faReq.Request.Status.Replicas > minReplicasCount {
-			faResp.Scale = true
-			faResp.Replicas = int32(math.Ceil(float64(faReq.Request.Status.Replicas) / scaleFactor))
 		}
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -253,11 +889,6 @@ func handleAutoscale(w http.ResponseWriter, r *http.Request) {
 		Request:  faReq.Request,
 		Response: &faResp,
 	}
-	// Enforce MAX_REPLICAS_COUNT for fixed override as well
-	if maxReplicasCount > 0 && faResp.Replicas > maxReplicasCount {
-		faResp.Scale = true
-		faResp.Replicas = maxReplicasCount
-	}
 
 	_ = json.NewEncoder(w).Encode(review)
 }
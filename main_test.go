@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	agonesv1 "agones.dev/agones/pkg/apis/agones/v1"
+	autoscalingv1 "agones.dev/agones/pkg/apis/autoscaling/v1"
+	"golang.org/x/time/rate"
+)
+
+func TestResolveIntOrPercent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		base    int32
+		roundUp bool
+		want    int32
+	}{
+		{name: "empty", value: "", base: 10, want: 0},
+		{name: "plain int", value: "4", base: 10, want: 4},
+		{name: "percent round down", value: "25%", base: 10, roundUp: false, want: 2},
+		{name: "percent round up", value: "25%", base: 10, roundUp: true, want: 3},
+		{name: "negative int rejected", value: "-5", base: 10, want: 0},
+		{name: "negative percent rejected", value: "-10%", base: 10, want: 0},
+		{name: "garbage rejected", value: "not-a-number", base: 10, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveIntOrPercent(tt.value, tt.base, tt.roundUp); got != tt.want {
+				t.Errorf("resolveIntOrPercent(%q, %d, %v) = %d, want %d", tt.value, tt.base, tt.roundUp, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateIntOrPercent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{name: "plain int", value: "2", wantErr: false},
+		{name: "percent", value: "25%", wantErr: false},
+		{name: "negative int rejected", value: "-1", wantErr: true},
+		{name: "negative percent rejected", value: "-1%", wantErr: true},
+		{name: "garbage rejected", value: "nope", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateIntOrPercent(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateIntOrPercent(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClampCapacity(t *testing.T) {
+	tests := []struct {
+		name    string
+		desired int64
+		policy  Policy
+		want    int64
+	}{
+		{name: "within bounds", desired: 50, policy: Policy{MinCapacity: 10, MaxCapacity: 100}, want: 50},
+		{name: "below min", desired: 5, policy: Policy{MinCapacity: 10, MaxCapacity: 100}, want: 10},
+		{name: "above max", desired: 150, policy: Policy{MinCapacity: 10, MaxCapacity: 100}, want: 100},
+		{name: "zero max means unbounded", desired: 1000, policy: Policy{MinCapacity: 10, MaxCapacity: 0}, want: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clampCapacity(tt.desired, tt.policy); got != tt.want {
+				t.Errorf("clampCapacity(%d, %+v) = %d, want %d", tt.desired, tt.policy, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGovernor(t *testing.T) {
+	tests := []struct {
+		name              string
+		current           int32
+		allocated         int32
+		next              int32
+		maxSurgeRaw       string
+		maxUnavailableRaw string
+		want              int32
+	}{
+		{
+			name:    "no-op when next equals current",
+			current: 10, allocated: 4, next: 10,
+			maxSurgeRaw: "1", maxUnavailableRaw: "1",
+			want: 10,
+		},
+		{
+			name:    "surge clamps scale-up past current+maxSurge",
+			current: 10, allocated: 4, next: 20,
+			maxSurgeRaw: "2", maxUnavailableRaw: "1",
+			want: 12,
+		},
+		{
+			name:    "scale-up within surge is untouched",
+			current: 10, allocated: 4, next: 11,
+			maxSurgeRaw: "2", maxUnavailableRaw: "1",
+			want: 11,
+		},
+		{
+			name:    "unset maxSurge leaves scale-up unbounded",
+			current: 10, allocated: 4, next: 50,
+			maxSurgeRaw: "", maxUnavailableRaw: "1",
+			want: 50,
+		},
+		{
+			name:    "maxUnavailable floors scale-down at allocated+maxUnavailable",
+			current: 10, allocated: 8, next: 2,
+			maxSurgeRaw: "2", maxUnavailableRaw: "1",
+			want: 9,
+		},
+		{
+			name:    "unset maxUnavailable never scales below allocated",
+			current: 10, allocated: 6, next: 0,
+			maxSurgeRaw: "2", maxUnavailableRaw: "",
+			want: 6,
+		},
+		{
+			name:    "scale-down above floor is untouched",
+			current: 10, allocated: 2, next: 7,
+			maxSurgeRaw: "2", maxUnavailableRaw: "1",
+			want: 7,
+		},
+		{
+			name:    "percent maxSurge",
+			current: 20, allocated: 4, next: 40,
+			maxSurgeRaw: "25%", maxUnavailableRaw: "1",
+			want: 25,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := governor(tt.current, tt.allocated, tt.next, tt.maxSurgeRaw, tt.maxUnavailableRaw)
+			if got != tt.want {
+				t.Errorf("governor(%d, %d, %d, %q, %q) = %d, want %d",
+					tt.current, tt.allocated, tt.next, tt.maxSurgeRaw, tt.maxUnavailableRaw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluatePolicies(t *testing.T) {
+	status := agonesv1.FleetStatus{
+		Counters: map[string]agonesv1.AggregatedCounterStatus{
+			"rooms": {Count: 80, Capacity: 100},
+		},
+		Lists: map[string]agonesv1.AggregatedListStatus{
+			"players": {Count: 45, Capacity: 50},
+		},
+	}
+
+	tests := []struct {
+		name            string
+		policies        []Policy
+		currentReplicas int32
+		wantReplicas    int32
+		wantMatched     bool
+	}{
+		{
+			name:            "no policies",
+			policies:        nil,
+			currentReplicas: 10,
+			wantReplicas:    0,
+			wantMatched:     false,
+		},
+		{
+			name: "unknown resource is skipped",
+			policies: []Policy{
+				{Resource: "missing", Kind: "Counter", BufferSize: "10%"},
+			},
+			currentReplicas: 10,
+			wantReplicas:    0,
+			wantMatched:     false,
+		},
+		{
+			name: "counter policy scales to keep buffer ahead of usage",
+			policies: []Policy{
+				{Resource: "rooms", Kind: "Counter", BufferSize: "10%", MaxCapacity: 100},
+			},
+			currentReplicas: 10,
+			// desiredCapacity = clamp(80 + ceil(100*0.10), [0,100]) = 90
+			// replicas = ceil(90 * 10 / 100) = 9
+			wantReplicas: 9,
+			wantMatched:  true,
+		},
+		{
+			name: "largest of multiple matched policies wins",
+			policies: []Policy{
+				{Resource: "rooms", Kind: "Counter", BufferSize: "10%", MaxCapacity: 100},
+				{Resource: "players", Kind: "List", BufferSize: "0", MaxCapacity: 50},
+			},
+			currentReplicas: 10,
+			// players: desiredCapacity = clamp(45+0, [0,50]) = 45, replicas = ceil(45*10/50) = 9
+			// rooms: replicas = 9 (as above); equal, so either wins -> 9
+			wantReplicas: 9,
+			wantMatched:  true,
+		},
+		{
+			name: "zero current replicas is skipped",
+			policies: []Policy{
+				{Resource: "rooms", Kind: "Counter", BufferSize: "10%", MaxCapacity: 100},
+			},
+			currentReplicas: 0,
+			wantReplicas:    0,
+			wantMatched:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotReplicas, gotMatched := evaluatePolicies(tt.policies, status, tt.currentReplicas)
+			if gotReplicas != tt.wantReplicas || gotMatched != tt.wantMatched {
+				t.Errorf("evaluatePolicies(...) = (%d, %v), want (%d, %v)", gotReplicas, gotMatched, tt.wantReplicas, tt.wantMatched)
+			}
+		})
+	}
+}
+
+// withScaleState temporarily points scaleState at a fresh, empty map and
+// restores the previous global on cleanup, so stabilize tests don't leak
+// state into each other or into main().
+func withScaleState(t *testing.T) {
+	t.Helper()
+	prev := scaleState
+	scaleState = map[string][]scaleDecision{}
+	t.Cleanup(func() {
+		scaleState = prev
+	})
+}
+
+func TestStabilize(t *testing.T) {
+	t.Run("zero window passes raw through untouched", func(t *testing.T) {
+		withScaleState(t)
+		now := time.Now()
+		if got := stabilize("fleet-a", 3, now, 0); got != 3 {
+			t.Errorf("stabilize(...) = %d, want 3", got)
+		}
+		if len(scaleState["fleet-a"]) != 0 {
+			t.Errorf("a disabled window should not record a decision, got %d", len(scaleState["fleet-a"]))
+		}
+	})
+
+	t.Run("scale-up wins immediately", func(t *testing.T) {
+		withScaleState(t)
+		now := time.Now()
+		if got := stabilize("fleet-a", 5, now, time.Minute); got != 5 {
+			t.Errorf("first call: stabilize(...) = %d, want 5", got)
+		}
+		if got := stabilize("fleet-a", 8, now.Add(time.Second), time.Minute); got != 8 {
+			t.Errorf("scale-up: stabilize(...) = %d, want 8", got)
+		}
+	})
+
+	t.Run("scale-down held until every decision in window agrees", func(t *testing.T) {
+		withScaleState(t)
+		now := time.Now()
+		stabilize("fleet-a", 10, now, time.Minute)
+		if got := stabilize("fleet-a", 4, now.Add(time.Second), time.Minute); got != 10 {
+			t.Errorf("scale-down disagreement: stabilize(...) = %d, want 10 (held)", got)
+		}
+		// By now the 10 has aged out of the window; only the earlier 4 remains.
+		if got := stabilize("fleet-a", 4, now.Add(time.Minute+500*time.Millisecond), time.Minute); got != 4 {
+			t.Errorf("scale-down agreement: stabilize(...) = %d, want 4", got)
+		}
+	})
+
+	t.Run("decisions outside the window expire", func(t *testing.T) {
+		withScaleState(t)
+		now := time.Now()
+		stabilize("fleet-a", 10, now, time.Minute)
+		got := stabilize("fleet-a", 4, now.Add(2*time.Minute), time.Minute)
+		if got != 4 {
+			t.Errorf("expired decision should no longer hold the scale-down: stabilize(...) = %d, want 4", got)
+		}
+	})
+
+	t.Run("independent keys don't interfere", func(t *testing.T) {
+		withScaleState(t)
+		now := time.Now()
+		stabilize("fleet-a", 10, now, time.Minute)
+		if got := stabilize("fleet-b", 2, now, time.Minute); got != 2 {
+			t.Errorf("fleet-b should be unaffected by fleet-a's history: stabilize(...) = %d, want 2", got)
+		}
+	})
+}
+
+func TestLoadProfilesStabilizationWindow(t *testing.T) {
+	prevDefault, prevProfiles := defaultProfile, profiles
+	defaultProfile.StabilizationWindow = "30s"
+	defaultProfile.stabilization = 30 * time.Second
+	t.Cleanup(func() {
+		defaultProfile, profiles = prevDefault, prevProfiles
+	})
+
+	t.Setenv("SCALING_PROFILES_JSON", `{
+		"inherits": {},
+		"overrides": {"stabilizationWindow": "5m"},
+		"opts-out": {"stabilizationWindow": ""}
+	}`)
+	loadProfiles()
+
+	if got := profiles["inherits"].stabilization; got != 30*time.Second {
+		t.Errorf("profile omitting stabilizationWindow: stabilization = %v, want inherited 30s", got)
+	}
+	if got := profiles["overrides"].stabilization; got != 5*time.Minute {
+		t.Errorf("profile overriding stabilizationWindow: stabilization = %v, want 5m", got)
+	}
+	if got := profiles["opts-out"].stabilization; got != 0 {
+		t.Errorf("profile with explicit empty stabilizationWindow: stabilization = %v, want 0 (disabled)", got)
+	}
+}
+
+// withProfiles temporarily points profiles at the given map and restores the
+// previous global on cleanup, so profile-selection tests don't leak state
+// into each other or into main().
+func withProfiles(t *testing.T, p map[string]Profile) {
+	t.Helper()
+	prev := profiles
+	profiles = p
+	t.Cleanup(func() {
+		profiles = prev
+	})
+}
+
+func TestHandleAutoscaleProfileSelection(t *testing.T) {
+	withProfiles(t, map[string]Profile{
+		defaultProfileName: {ReplicaUpperThreshold: 0.7, ReplicaLowerThreshold: 0.3, ScaleFactor: 2, MinReplicas: "2"},
+		"aggressive":       {ReplicaUpperThreshold: 0.4, ReplicaLowerThreshold: 0.1, ScaleFactor: 2, MinReplicas: "2"},
+	})
+
+	tests := []struct {
+		name       string
+		annotation string
+		wantScale  bool
+	}{
+		{name: "no annotation uses default profile", annotation: "", wantScale: false},
+		{name: "known annotation selects named profile", annotation: "aggressive", wantScale: true},
+		{name: "unknown annotation falls back to default profile", annotation: "does-not-exist", wantScale: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withScaleState(t)
+			review := autoscalingv1.FleetAutoscaleReview{
+				Request: &autoscalingv1.FleetAutoscaleRequest{
+					Name:   "fleet-x",
+					Status: agonesv1.FleetStatus{Replicas: 10, AllocatedReplicas: 5},
+				},
+			}
+			if tt.annotation != "" {
+				review.Request.Annotations = map[string]string{"scalingProfile": tt.annotation}
+			}
+			body, _ := json.Marshal(review)
+			req := httptest.NewRequest(http.MethodPost, "/scale", bytes.NewReader(body))
+			rec := httptest.NewRecorder()
+
+			handleAutoscale(rec, req)
+
+			var got autoscalingv1.FleetAutoscaleReview
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding response body: %v", err)
+			}
+			if got.Response.Scale != tt.wantScale {
+				t.Errorf("Response.Scale = %v, want %v", got.Response.Scale, tt.wantScale)
+			}
+		})
+	}
+}
+
+func TestHandleAutoscaleGovernorNoOpDoesNotReportScale(t *testing.T) {
+	// ReplicaLowerThreshold is set unrealistically high purely to exercise
+	// the scale-down branch; the point of the test is what happens once the
+	// governor's allocated+maxUnavailable floor lands exactly back on the
+	// fleet's current replica count, not the threshold that got us there.
+	withProfiles(t, map[string]Profile{
+		defaultProfileName: {
+			ReplicaUpperThreshold: 2.0,
+			ReplicaLowerThreshold: 0.95,
+			ScaleFactor:           2,
+			MinReplicas:           "0",
+			MaxUnavailable:        "1",
+		},
+	})
+	withScaleState(t)
+
+	body, _ := json.Marshal(autoscalingv1.FleetAutoscaleReview{
+		Request: &autoscalingv1.FleetAutoscaleRequest{
+			Name:   "fleet-x",
+			Status: agonesv1.FleetStatus{Replicas: 10, AllocatedReplicas: 9},
+		},
+	})
+	req := httptest.NewRequest(http.MethodPost, "/scale", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+
+	handleAutoscale(rec, req)
+
+	var got autoscalingv1.FleetAutoscaleReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding response body: %v", err)
+	}
+	if got.Response.Scale {
+		t.Errorf("Response.Scale = true, want false: governor floored replicas back to the current count (%d), so this should be a no-op", got.Response.Replicas)
+	}
+	if got.Response.Replicas != 10 {
+		t.Errorf("Response.Replicas = %d, want 10 (unchanged)", got.Response.Replicas)
+	}
+}
+
+// withFleetLimiterBudget temporarily sets fleetRPS/fleetBurst to rps/burst,
+// points fleetLimiters at a fresh, empty map and restores the previous
+// globals on cleanup, so
+// rate-limiter tests don't leak state into each other or into main().
+func withFleetLimiterBudget(t *testing.T, rps float64, burst int) {
+	t.Helper()
+	prevRPS, prevBurst, prevLimiters := fleetRPS, fleetBurst, fleetLimiters
+	fleetRPS, fleetBurst, fleetLimiters = rps, burst, map[string]*fleetLimiterEntry{}
+	t.Cleanup(func() {
+		fleetRPS, fleetBurst, fleetLimiters = prevRPS, prevBurst, prevLimiters
+	})
+}
+
+func TestFleetLimiterFairness(t *testing.T) {
+	withFleetLimiterBudget(t, 0, 1)
+	now := time.Now()
+
+	if !fleetLimiter("fleet-a", now).Allow() {
+		t.Fatal("fleet-a should get its first token from a fresh limiter")
+	}
+	if fleetLimiter("fleet-a", now).Allow() {
+		t.Fatal("fleet-a exhausted its single-token burst and should be denied")
+	}
+	if !fleetLimiter("fleet-b", now).Allow() {
+		t.Fatal("fleet-b has its own independent budget and should not be starved by fleet-a")
+	}
+}
+
+func TestRateLimitMiddlewareTripsOnGlobalLimit(t *testing.T) {
+	prevGlobal := globalLimiter
+	withFleetLimiterBudget(t, 100, 100)
+	globalLimiter = rate.NewLimiter(0, 0)
+	t.Cleanup(func() { globalLimiter = prevGlobal })
+
+	called := false
+	handler := rateLimitMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusOK)
+	})
+
+	body, _ := json.Marshal(autoscalingv1.FleetAutoscaleReview{
+		Request: &autoscalingv1.FleetAutoscaleRequest{
+			Name:   "fleet-x",
+			Status: agonesv1.FleetStatus{Replicas: 5},
+		},
+	})
+	req := httptest.NewRequest(http.MethodPost, "/scale", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+
+	handler(rec, req)
+
+	if called {
+		t.Fatal("handler should not run once the global limiter trips")
+	}
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+
+	var review autoscalingv1.FleetAutoscaleReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+		t.Fatalf("decoding response body: %v", err)
+	}
+	if review.Response == nil || review.Response.Scale {
+		t.Fatalf("response = %+v, want Scale=false", review.Response)
+	}
+}
+
+func TestRateLimitMiddlewarePassesThroughWhenDisabled(t *testing.T) {
+	prevGlobal := globalLimiter
+	globalLimiter = nil
+	t.Cleanup(func() { globalLimiter = prevGlobal })
+
+	called := false
+	handler := rateLimitMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/scale", bytes.NewReader([]byte(`{}`)))
+	rec := httptest.NewRecorder()
+
+	handler(rec, req)
+
+	if !called {
+		t.Fatal("handler should run when no global limiter is configured")
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}